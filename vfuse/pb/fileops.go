@@ -0,0 +1,347 @@
+package pb
+
+import "code.google.com/p/goprotobuf/proto"
+
+// Messages for the write-path and metadata operations that round out
+// FS: Write, Create, Access, Link, the extended-attribute family, and
+// Fsync. They follow the same shape as the rest of this package: every
+// field is optional (a pointer, or a slice for repeated/bytes fields),
+// and each scalar field has a GetFoo accessor that returns the zero
+// value on a nil receiver or a nil field.
+
+// WriteRequest asks the client to write Data to the open file
+// identified by Handle, starting at Offset.
+type WriteRequest struct {
+	Handle *uint64
+	Offset *uint64
+	Data   []byte
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (m *WriteRequest) ProtoMessage()  {}
+
+func (m *WriteRequest) GetHandle() uint64 {
+	if m != nil && m.Handle != nil {
+		return *m.Handle
+	}
+	return 0
+}
+
+func (m *WriteRequest) GetOffset() uint64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+// WriteResponse reports how many bytes were written.
+type WriteResponse struct {
+	Written *uint32
+	Err     *Error
+}
+
+func (m *WriteResponse) Reset()         { *m = WriteResponse{} }
+func (m *WriteResponse) String() string { return proto.CompactTextString(m) }
+func (m *WriteResponse) ProtoMessage()  {}
+
+func (m *WriteResponse) GetWritten() uint32 {
+	if m != nil && m.Written != nil {
+		return *m.Written
+	}
+	return 0
+}
+
+// CreateRequest asks the client to create and open Name with Mode and
+// open Flags.
+type CreateRequest struct {
+	Name  *string
+	Flags *uint32
+	Mode  *uint32
+}
+
+func (m *CreateRequest) Reset()         { *m = CreateRequest{} }
+func (m *CreateRequest) String() string { return proto.CompactTextString(m) }
+func (m *CreateRequest) ProtoMessage()  {}
+
+func (m *CreateRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *CreateRequest) GetFlags() uint32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
+func (m *CreateRequest) GetMode() uint32 {
+	if m != nil && m.Mode != nil {
+		return *m.Mode
+	}
+	return 0
+}
+
+// CreateResponse returns the handle of the newly created, open file.
+type CreateResponse struct {
+	Handle *uint64
+	Err    *Error
+}
+
+func (m *CreateResponse) Reset()         { *m = CreateResponse{} }
+func (m *CreateResponse) String() string { return proto.CompactTextString(m) }
+func (m *CreateResponse) ProtoMessage()  {}
+
+func (m *CreateResponse) GetHandle() uint64 {
+	if m != nil && m.Handle != nil {
+		return *m.Handle
+	}
+	return 0
+}
+
+// AccessRequest asks the client to check Name against the access mode
+// bits in Mask (R_OK/W_OK/X_OK/F_OK).
+type AccessRequest struct {
+	Name *string
+	Mask *uint32
+}
+
+func (m *AccessRequest) Reset()         { *m = AccessRequest{} }
+func (m *AccessRequest) String() string { return proto.CompactTextString(m) }
+func (m *AccessRequest) ProtoMessage()  {}
+
+func (m *AccessRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *AccessRequest) GetMask() uint32 {
+	if m != nil && m.Mask != nil {
+		return *m.Mask
+	}
+	return 0
+}
+
+// AccessResponse carries only a possible error; access is granted iff
+// Err is nil.
+type AccessResponse struct {
+	Err *Error
+}
+
+func (m *AccessResponse) Reset()         { *m = AccessResponse{} }
+func (m *AccessResponse) String() string { return proto.CompactTextString(m) }
+func (m *AccessResponse) ProtoMessage()  {}
+
+// LinkRequest asks the client to create a hard link at Name pointing
+// at the existing file Target.
+type LinkRequest struct {
+	Target *string
+	Name   *string
+}
+
+func (m *LinkRequest) Reset()         { *m = LinkRequest{} }
+func (m *LinkRequest) String() string { return proto.CompactTextString(m) }
+func (m *LinkRequest) ProtoMessage()  {}
+
+func (m *LinkRequest) GetTarget() string {
+	if m != nil && m.Target != nil {
+		return *m.Target
+	}
+	return ""
+}
+
+func (m *LinkRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+// LinkResponse carries only a possible error.
+type LinkResponse struct {
+	Err *Error
+}
+
+func (m *LinkResponse) Reset()         { *m = LinkResponse{} }
+func (m *LinkResponse) String() string { return proto.CompactTextString(m) }
+func (m *LinkResponse) ProtoMessage()  {}
+
+// XAttrGetRequest asks the client for the value of extended attribute
+// Attr on Name.
+type XAttrGetRequest struct {
+	Name *string
+	Attr *string
+}
+
+func (m *XAttrGetRequest) Reset()         { *m = XAttrGetRequest{} }
+func (m *XAttrGetRequest) String() string { return proto.CompactTextString(m) }
+func (m *XAttrGetRequest) ProtoMessage()  {}
+
+func (m *XAttrGetRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *XAttrGetRequest) GetAttr() string {
+	if m != nil && m.Attr != nil {
+		return *m.Attr
+	}
+	return ""
+}
+
+// XAttrGetResponse carries the attribute's value.
+type XAttrGetResponse struct {
+	Data []byte
+	Err  *Error
+}
+
+func (m *XAttrGetResponse) Reset()         { *m = XAttrGetResponse{} }
+func (m *XAttrGetResponse) String() string { return proto.CompactTextString(m) }
+func (m *XAttrGetResponse) ProtoMessage()  {}
+
+// XAttrSetRequest asks the client to set extended attribute Attr on
+// Name to Data, with setxattr(2) Flags (XATTR_CREATE/XATTR_REPLACE).
+type XAttrSetRequest struct {
+	Name  *string
+	Attr  *string
+	Data  []byte
+	Flags *uint32
+}
+
+func (m *XAttrSetRequest) Reset()         { *m = XAttrSetRequest{} }
+func (m *XAttrSetRequest) String() string { return proto.CompactTextString(m) }
+func (m *XAttrSetRequest) ProtoMessage()  {}
+
+func (m *XAttrSetRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *XAttrSetRequest) GetAttr() string {
+	if m != nil && m.Attr != nil {
+		return *m.Attr
+	}
+	return ""
+}
+
+func (m *XAttrSetRequest) GetFlags() uint32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
+// XAttrSetResponse carries only a possible error.
+type XAttrSetResponse struct {
+	Err *Error
+}
+
+func (m *XAttrSetResponse) Reset()         { *m = XAttrSetResponse{} }
+func (m *XAttrSetResponse) String() string { return proto.CompactTextString(m) }
+func (m *XAttrSetResponse) ProtoMessage()  {}
+
+// XAttrListRequest asks the client for the set of extended attribute
+// names set on Name.
+type XAttrListRequest struct {
+	Name *string
+}
+
+func (m *XAttrListRequest) Reset()         { *m = XAttrListRequest{} }
+func (m *XAttrListRequest) String() string { return proto.CompactTextString(m) }
+func (m *XAttrListRequest) ProtoMessage()  {}
+
+func (m *XAttrListRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+// XAttrListResponse carries the NUL-separated attribute names, as
+// listxattr(2) returns them.
+type XAttrListResponse struct {
+	Names []byte
+	Err   *Error
+}
+
+func (m *XAttrListResponse) Reset()         { *m = XAttrListResponse{} }
+func (m *XAttrListResponse) String() string { return proto.CompactTextString(m) }
+func (m *XAttrListResponse) ProtoMessage()  {}
+
+// XAttrRemoveRequest asks the client to remove extended attribute
+// Attr from Name.
+type XAttrRemoveRequest struct {
+	Name *string
+	Attr *string
+}
+
+func (m *XAttrRemoveRequest) Reset()         { *m = XAttrRemoveRequest{} }
+func (m *XAttrRemoveRequest) String() string { return proto.CompactTextString(m) }
+func (m *XAttrRemoveRequest) ProtoMessage()  {}
+
+func (m *XAttrRemoveRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *XAttrRemoveRequest) GetAttr() string {
+	if m != nil && m.Attr != nil {
+		return *m.Attr
+	}
+	return ""
+}
+
+// XAttrRemoveResponse carries only a possible error.
+type XAttrRemoveResponse struct {
+	Err *Error
+}
+
+func (m *XAttrRemoveResponse) Reset()         { *m = XAttrRemoveResponse{} }
+func (m *XAttrRemoveResponse) String() string { return proto.CompactTextString(m) }
+func (m *XAttrRemoveResponse) ProtoMessage()  {}
+
+// FsyncRequest asks the client to flush the open file identified by
+// Handle to stable storage. DataOnly mirrors fdatasync(2) semantics
+// (skip metadata-only flushes) when true.
+type FsyncRequest struct {
+	Handle   *uint64
+	DataOnly *bool
+}
+
+func (m *FsyncRequest) Reset()         { *m = FsyncRequest{} }
+func (m *FsyncRequest) String() string { return proto.CompactTextString(m) }
+func (m *FsyncRequest) ProtoMessage()  {}
+
+func (m *FsyncRequest) GetHandle() uint64 {
+	if m != nil && m.Handle != nil {
+		return *m.Handle
+	}
+	return 0
+}
+
+func (m *FsyncRequest) GetDataOnly() bool {
+	if m != nil && m.DataOnly != nil {
+		return *m.DataOnly
+	}
+	return false
+}
+
+// FsyncResponse carries only a possible error.
+type FsyncResponse struct {
+	Err *Error
+}
+
+func (m *FsyncResponse) Reset()         { *m = FsyncResponse{} }
+func (m *FsyncResponse) String() string { return proto.CompactTextString(m) }
+func (m *FsyncResponse) ProtoMessage()  {}
@@ -0,0 +1,72 @@
+package pb
+
+import "code.google.com/p/goprotobuf/proto"
+
+// InvalidateNotification is pushed by the client to the server
+// unsolicited (as a packet with Header.ID == 0, never replied to) to
+// report that something changed out from under the server's cache:
+// a directory entry, a byte range of an open file, or a removed
+// name. Exactly one of the three field groups below is populated;
+// which one is told apart by GetDeleted/the Dir/Handle fields, the
+// same way pb.Error tells apart its error kinds.
+type InvalidateNotification struct {
+	// Entry: the directory listing entry Name under Dir changed
+	// (created, replaced, or its attributes are now stale).
+	Dir  *string
+	Name *string
+
+	// Inode: bytes [Offset, Offset+Length) of the open file
+	// identified by Handle changed.
+	Handle *uint64
+	Offset *int64
+	Length *int64
+
+	// Delete: Name was removed from Dir. Reuses Dir/Name above.
+	Deleted *bool
+}
+
+func (m *InvalidateNotification) Reset()         { *m = InvalidateNotification{} }
+func (m *InvalidateNotification) String() string { return proto.CompactTextString(m) }
+func (m *InvalidateNotification) ProtoMessage()  {}
+
+func (m *InvalidateNotification) GetDir() string {
+	if m != nil && m.Dir != nil {
+		return *m.Dir
+	}
+	return ""
+}
+
+func (m *InvalidateNotification) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *InvalidateNotification) GetHandle() uint64 {
+	if m != nil && m.Handle != nil {
+		return *m.Handle
+	}
+	return 0
+}
+
+func (m *InvalidateNotification) GetOffset() int64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+func (m *InvalidateNotification) GetLength() int64 {
+	if m != nil && m.Length != nil {
+		return *m.Length
+	}
+	return 0
+}
+
+func (m *InvalidateNotification) GetDeleted() bool {
+	if m != nil && m.Deleted != nil {
+		return *m.Deleted
+	}
+	return false
+}
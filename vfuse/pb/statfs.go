@@ -0,0 +1,86 @@
+package pb
+
+import "code.google.com/p/goprotobuf/proto"
+
+// StatfsRequest asks the client for filesystem-wide space and inode
+// usage, as statfs(2) would report it for Name.
+type StatfsRequest struct {
+	Name *string
+}
+
+func (m *StatfsRequest) Reset()         { *m = StatfsRequest{} }
+func (m *StatfsRequest) String() string { return proto.CompactTextString(m) }
+func (m *StatfsRequest) ProtoMessage()  {}
+
+func (m *StatfsRequest) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+// StatfsResponse carries the client's real statfs(2) answer, field
+// for field matching fuse.StatfsOut.
+type StatfsResponse struct {
+	Bsize   *uint32
+	Blocks  *uint64
+	Bfree   *uint64
+	Bavail  *uint64
+	Files   *uint64
+	Ffree   *uint64
+	Namelen *uint32
+	Err     *Error
+}
+
+func (m *StatfsResponse) Reset()         { *m = StatfsResponse{} }
+func (m *StatfsResponse) String() string { return proto.CompactTextString(m) }
+func (m *StatfsResponse) ProtoMessage()  {}
+
+func (m *StatfsResponse) GetBsize() uint32 {
+	if m != nil && m.Bsize != nil {
+		return *m.Bsize
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetBlocks() uint64 {
+	if m != nil && m.Blocks != nil {
+		return *m.Blocks
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetBfree() uint64 {
+	if m != nil && m.Bfree != nil {
+		return *m.Bfree
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetBavail() uint64 {
+	if m != nil && m.Bavail != nil {
+		return *m.Bavail
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetFiles() uint64 {
+	if m != nil && m.Files != nil {
+		return *m.Files
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetFfree() uint64 {
+	if m != nil && m.Ffree != nil {
+		return *m.Ffree
+	}
+	return 0
+}
+
+func (m *StatfsResponse) GetNamelen() uint32 {
+	if m != nil && m.Namelen != nil {
+		return *m.Namelen
+	}
+	return 0
+}
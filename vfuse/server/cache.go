@@ -0,0 +1,222 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockSize is the granularity at which file contents are cached. Reads
+// are always satisfied by fetching whole BlockSize-aligned blocks from
+// the client, so that sequential reads of the same block coalesce into
+// a single upstream ReadRequest.
+const BlockSize = 1 << 20 // 1 MiB
+
+// Default cache budgets used when a Server is created with a zero
+// CacheOptions.
+const (
+	DefaultPerFileCacheBytes = 16 << 20  // 16 MiB
+	DefaultGlobalCacheBytes  = 256 << 20 // 256 MiB
+)
+
+// CacheOptions configures the block cache that sits in front of every
+// file's Read path. The zero value selects the defaults above.
+type CacheOptions struct {
+	// PerFileMaxBytes caps how many bytes of a single open file's
+	// blocks may be cached at once.
+	PerFileMaxBytes int64
+	// GlobalMaxBytes caps the total number of cached bytes across
+	// all open files.
+	GlobalMaxBytes int64
+}
+
+func (o CacheOptions) withDefaults() CacheOptions {
+	if o.PerFileMaxBytes <= 0 {
+		o.PerFileMaxBytes = DefaultPerFileCacheBytes
+	}
+	if o.GlobalMaxBytes <= 0 {
+		o.GlobalMaxBytes = DefaultGlobalCacheBytes
+	}
+	return o
+}
+
+// CacheStats reports cumulative block cache activity. It's safe to read
+// concurrently with cache use.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Coalesced int64
+}
+
+// CacheBlock is one cached BlockSize-aligned chunk of a file's
+// contents. Its mutex serializes concurrent fetches of the same
+// block: the first reader to arrive fills it in, and everyone else
+// blocks on mu and then finds valid already true.
+type CacheBlock struct {
+	mu    sync.Mutex
+	data  []byte
+	valid bool
+}
+
+type blockKey struct {
+	handle uint64
+	off    int64
+}
+
+// blockCache is an LRU cache of CacheBlocks shared by every open file
+// on an FS. It enforces both a global byte budget and, per file
+// handle, a per-file byte budget.
+type blockCache struct {
+	mu         sync.Mutex
+	ll         *list.List // front = most recently used
+	items      map[blockKey]*list.Element
+	nbytes     int64
+	perFile    map[uint64]int64
+	maxPerFile int64
+	maxGlobal  int64
+
+	hits, misses, coalesced int64
+}
+
+type blockEntry struct {
+	key   blockKey
+	block *CacheBlock
+}
+
+func newBlockCache(opts CacheOptions) *blockCache {
+	opts = opts.withDefaults()
+	return &blockCache{
+		ll:         list.New(),
+		items:      make(map[blockKey]*list.Element),
+		perFile:    make(map[uint64]int64),
+		maxPerFile: opts.PerFileMaxBytes,
+		maxGlobal:  opts.GlobalMaxBytes,
+	}
+}
+
+// getOrCreate returns the CacheBlock for (handle, off), creating and
+// inserting an empty (not-yet-valid) one if necessary. The caller is
+// responsible for locking the returned block before inspecting or
+// filling in its data.
+func (c *blockCache) getOrCreate(handle uint64, off int64) *CacheBlock {
+	key := blockKey{handle, off}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*blockEntry).block
+	}
+
+	c.evictLocked(handle)
+
+	block := &CacheBlock{}
+	e := c.ll.PushFront(&blockEntry{key: key, block: block})
+	c.items[key] = e
+	c.nbytes += BlockSize
+	c.perFile[handle] += BlockSize
+	return block
+}
+
+// evictLocked makes room for one more block on behalf of handle,
+// first by trimming handle's own cache down to its per-file budget,
+// then, if still over the global budget, by evicting the
+// least-recently-used blocks regardless of which handle owns them.
+// c.mu must be held.
+func (c *blockCache) evictLocked(handle uint64) {
+	for c.perFile[handle]+BlockSize > c.maxPerFile {
+		if !c.evictOneOwnedByLocked(handle) {
+			break
+		}
+	}
+	for c.nbytes+BlockSize > c.maxGlobal {
+		if !c.evictOldestLocked() {
+			break
+		}
+	}
+}
+
+func (c *blockCache) evictOneOwnedByLocked(handle uint64) bool {
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		ent := e.Value.(*blockEntry)
+		if ent.key.handle == handle {
+			c.removeLocked(e, ent)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *blockCache) evictOldestLocked() bool {
+	e := c.ll.Back()
+	if e == nil {
+		return false
+	}
+	c.removeLocked(e, e.Value.(*blockEntry))
+	return true
+}
+
+func (c *blockCache) removeLocked(e *list.Element, ent *blockEntry) {
+	c.ll.Remove(e)
+	delete(c.items, ent.key)
+	c.nbytes -= BlockSize
+	c.perFile[ent.key.handle] -= BlockSize
+	if c.perFile[ent.key.handle] <= 0 {
+		delete(c.perFile, ent.key.handle)
+	}
+}
+
+// invalidateBlock evicts the single block at (handle, off), if cached.
+func (c *blockCache) invalidateBlock(handle uint64, off int64) {
+	key := blockKey{handle, off}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeLocked(e, e.Value.(*blockEntry))
+	}
+}
+
+// invalidateRange evicts every cached block overlapping [off, off+size).
+// Used by Write, which (unlike Truncate) only touches part of a file.
+func (c *blockCache) invalidateRange(handle uint64, off, size int64) {
+	if size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for b := blockStart(off); b < off+size; b += BlockSize {
+		key := blockKey{handle, b}
+		if e, ok := c.items[key]; ok {
+			c.removeLocked(e, e.Value.(*blockEntry))
+		}
+	}
+}
+
+// invalidateFile evicts every block belonging to handle. Used when a
+// file's contents or metadata may have changed (Truncate, Chmod,
+// Utimens, ...) or when the handle is going away (Flush).
+func (c *blockCache) invalidateFile(handle uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		ent := e.Value.(*blockEntry)
+		if ent.key.handle == handle {
+			c.removeLocked(e, ent)
+		}
+		e = next
+	}
+}
+
+func blockStart(off int64) int64 {
+	return off - off%BlockSize
+}
+
+func (c *blockCache) stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Coalesced: atomic.LoadInt64(&c.coalesced),
+	}
+}
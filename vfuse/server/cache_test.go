@@ -0,0 +1,143 @@
+package server
+
+import "testing"
+
+func TestBlockCacheGetOrCreateReusesBlock(t *testing.T) {
+	c := newBlockCache(CacheOptions{})
+	b1 := c.getOrCreate(1, 0)
+	b2 := c.getOrCreate(1, 0)
+	if b1 != b2 {
+		t.Fatalf("getOrCreate returned different blocks for the same (handle, off)")
+	}
+}
+
+func TestBlockCacheEvictsPerFileBeforeGlobal(t *testing.T) {
+	// Two files, each allowed only one block, sharing a global budget
+	// big enough for both: filling a second block on handle 1 must
+	// evict handle 1's own oldest block, not handle 2's.
+	c := newBlockCache(CacheOptions{
+		PerFileMaxBytes: BlockSize,
+		GlobalMaxBytes:  4 * BlockSize,
+	})
+
+	c.getOrCreate(1, 0*BlockSize)
+	c.getOrCreate(2, 0*BlockSize)
+	c.getOrCreate(1, 1*BlockSize)
+
+	if _, ok := c.items[blockKey{1, 0 * BlockSize}]; ok {
+		t.Errorf("handle 1's first block should have been evicted by its own per-file budget")
+	}
+	if _, ok := c.items[blockKey{1, 1 * BlockSize}]; !ok {
+		t.Errorf("handle 1's second block should still be cached")
+	}
+	if _, ok := c.items[blockKey{2, 0 * BlockSize}]; !ok {
+		t.Errorf("handle 2's block should be untouched by handle 1's eviction")
+	}
+}
+
+func TestBlockCacheEvictsGloballyWhenOverGlobalBudget(t *testing.T) {
+	// Per-file budget is generous; only the global budget should bite,
+	// evicting the least-recently-used block regardless of owner.
+	c := newBlockCache(CacheOptions{
+		PerFileMaxBytes: 8 * BlockSize,
+		GlobalMaxBytes:  2 * BlockSize,
+	})
+
+	c.getOrCreate(1, 0) // oldest
+	c.getOrCreate(2, 0)
+	c.getOrCreate(3, 0) // forces an eviction
+
+	if len(c.items) != 2 {
+		t.Fatalf("expected global budget to cap the cache at 2 blocks, got %d", len(c.items))
+	}
+	if _, ok := c.items[blockKey{1, 0}]; ok {
+		t.Errorf("least-recently-used block (handle 1) should have been evicted")
+	}
+}
+
+func TestBlockCacheMoveToFrontProtectsRecentlyUsed(t *testing.T) {
+	c := newBlockCache(CacheOptions{
+		PerFileMaxBytes: 8 * BlockSize,
+		GlobalMaxBytes:  2 * BlockSize,
+	})
+
+	c.getOrCreate(1, 0)
+	c.getOrCreate(2, 0)
+	c.getOrCreate(1, 0) // touch handle 1's block again; handle 2's is now oldest
+	c.getOrCreate(3, 0)
+
+	if _, ok := c.items[blockKey{1, 0}]; !ok {
+		t.Errorf("recently touched block (handle 1) should have survived eviction")
+	}
+	if _, ok := c.items[blockKey{2, 0}]; ok {
+		t.Errorf("untouched block (handle 2) should have been evicted instead")
+	}
+}
+
+func TestBlockCacheInvalidateBlock(t *testing.T) {
+	c := newBlockCache(CacheOptions{})
+	c.getOrCreate(1, 0)
+	c.invalidateBlock(1, 0)
+	if _, ok := c.items[blockKey{1, 0}]; ok {
+		t.Errorf("invalidateBlock left the block cached")
+	}
+	if c.nbytes != 0 || c.perFile[1] != 0 {
+		t.Errorf("invalidateBlock didn't release its accounting: nbytes=%d perFile=%d", c.nbytes, c.perFile[1])
+	}
+}
+
+func TestBlockCacheInvalidateRangeOnlyTouchesOverlap(t *testing.T) {
+	c := newBlockCache(CacheOptions{})
+	c.getOrCreate(1, 0)
+	c.getOrCreate(1, BlockSize)
+	c.getOrCreate(1, 2*BlockSize)
+
+	c.invalidateRange(1, BlockSize/2, BlockSize) // overlaps blocks 0 and 1 only
+
+	if _, ok := c.items[blockKey{1, 0}]; ok {
+		t.Errorf("block 0 should have been invalidated")
+	}
+	if _, ok := c.items[blockKey{1, BlockSize}]; ok {
+		t.Errorf("block 1 should have been invalidated")
+	}
+	if _, ok := c.items[blockKey{1, 2 * BlockSize}]; !ok {
+		t.Errorf("block 2 is outside the range and should still be cached")
+	}
+}
+
+func TestBlockCacheInvalidateFile(t *testing.T) {
+	c := newBlockCache(CacheOptions{})
+	c.getOrCreate(1, 0)
+	c.getOrCreate(1, BlockSize)
+	c.getOrCreate(2, 0)
+
+	c.invalidateFile(1)
+
+	if _, ok := c.items[blockKey{1, 0}]; ok {
+		t.Errorf("handle 1's blocks should be gone")
+	}
+	if _, ok := c.items[blockKey{1, BlockSize}]; ok {
+		t.Errorf("handle 1's blocks should be gone")
+	}
+	if _, ok := c.items[blockKey{2, 0}]; !ok {
+		t.Errorf("handle 2's block should be untouched")
+	}
+	if _, ok := c.perFile[1]; ok {
+		t.Errorf("invalidateFile should have dropped handle 1's perFile accounting entirely")
+	}
+}
+
+func TestBlockStart(t *testing.T) {
+	cases := []struct{ off, want int64 }{
+		{0, 0},
+		{1, 0},
+		{BlockSize - 1, 0},
+		{BlockSize, BlockSize},
+		{BlockSize + 1, BlockSize},
+	}
+	for _, c := range cases {
+		if got := blockStart(c.off); got != c.want {
+			t.Errorf("blockStart(%d) = %d, want %d", c.off, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/vfuse/pb"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Tunables for the request scheduler. See SchedulerOptions.
+// withDefaults applies DefaultMaxInFlight and DefaultCoalesceWindow;
+// it does not apply DefaultReadAhead, so a zero ReadAhead leaves
+// read-ahead off.
+const (
+	DefaultMaxInFlight    = 64
+	DefaultCoalesceWindow = 2 * time.Millisecond
+	DefaultReadAhead      = 2
+)
+
+// SchedulerOptions tunes how FS pipelines requests to the client: how
+// many may be outstanding at once, how long an overlapping block
+// fetch waits for siblings before firing its own upstream read, and
+// how many blocks ahead a sequential reader prefetches.
+type SchedulerOptions struct {
+	// MaxInFlight bounds how many requests this connection may have
+	// outstanding to the client at once.
+	MaxInFlight int
+	// CoalesceWindow is how long a block fetch waits for adjacent
+	// or overlapping fetches on the same handle before issuing its
+	// own upstream ReadRequest.
+	CoalesceWindow time.Duration
+	// ReadAhead is how many additional blocks are speculatively
+	// fetched once sequential access is detected on a file handle.
+	// Zero disables read-ahead.
+	ReadAhead int
+}
+
+func (o SchedulerOptions) withDefaults() SchedulerOptions {
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = DefaultMaxInFlight
+	}
+	if o.CoalesceWindow <= 0 {
+		o.CoalesceWindow = DefaultCoalesceWindow
+	}
+	if o.ReadAhead < 0 {
+		o.ReadAhead = 0
+	}
+	return o
+}
+
+// blockFetch is one caller's request for the BlockSize-aligned block
+// starting at off on a given handle, queued up for the fetchBatcher.
+type blockFetch struct {
+	off  int64
+	resc chan blockFetchResult
+}
+
+type blockFetchResult struct {
+	data []byte
+	st   fuse.Status
+}
+
+// fetchBatcher coalesces block fetches that land on the same handle
+// within a short window into a single upstream ReadRequest spanning
+// their union, fanning the result back out to each waiter. This is
+// what lets a sequential read and its read-ahead blocks travel over
+// the wire as one round-trip instead of several.
+type fetchBatcher struct {
+	fs     *FS
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[uint64][]*blockFetch
+}
+
+func newFetchBatcher(fs *FS, window time.Duration) *fetchBatcher {
+	return &fetchBatcher{
+		fs:      fs,
+		window:  window,
+		pending: make(map[uint64][]*blockFetch),
+	}
+}
+
+func (b *fetchBatcher) fetch(ctx context.Context, handle uint64, off int64) ([]byte, fuse.Status) {
+	f := &blockFetch{off: off, resc: make(chan blockFetchResult, 1)}
+
+	b.mu.Lock()
+	b.pending[handle] = append(b.pending[handle], f)
+	first := len(b.pending[handle]) == 1
+	b.mu.Unlock()
+
+	if first {
+		time.AfterFunc(b.window, func() { b.flush(handle) })
+	}
+
+	select {
+	case res := <-f.resc:
+		return res.data, res.st
+	case <-ctx.Done():
+		return nil, fuse.EIO
+	}
+}
+
+// flush issues the single coalesced upstream fetch for everyone
+// waiting on handle and fans the result back out. The upstream fetch
+// uses context.Background() rather than any one waiter's ctx: it's
+// now serving every fetch in the batch, so it must not die because
+// the waiter that happened to start the window (often a read-ahead
+// fetch racing the Flush that cancels it) gave up first. Each
+// waiter's own fetch still respects its own ctx via the select above.
+func (b *fetchBatcher) flush(handle uint64) {
+	b.mu.Lock()
+	fetches := b.pending[handle]
+	delete(b.pending, handle)
+	b.mu.Unlock()
+	if len(fetches) == 0 {
+		return
+	}
+
+	sort.Slice(fetches, func(i, j int) bool { return fetches[i].off < fetches[j].off })
+	lo := fetches[0].off
+	hi := fetches[len(fetches)-1].off + BlockSize
+
+	data, st := b.fs.fetchRange(context.Background(), handle, lo, hi-lo)
+	for _, f := range fetches {
+		f.resc <- blockSlice(f, lo, data, st)
+	}
+}
+
+// blockSlice picks f's own BlockSize-aligned slice out of data, the
+// result of the single coalesced fetch spanning [lo, lo+len(data)).
+// Pulled out of flush as a pure function so the boundary math
+// (including the short-read/EOF clamp) can be tested without an FS.
+func blockSlice(f *blockFetch, lo int64, data []byte, st fuse.Status) blockFetchResult {
+	if !st.Ok() {
+		return blockFetchResult{st: st}
+	}
+	start, end := f.off-lo, f.off-lo+BlockSize
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	if start > end {
+		start = end
+	}
+	return blockFetchResult{data: data[start:end], st: fuse.OK}
+}
+
+// readRequestPool recycles pb.ReadRequest structs across calls to
+// fetchRange, which on a sequential read (original plus read-ahead)
+// is by far the hottest of the request types sendPacketCtx marshals.
+// It's safe to return a request to the pool as soon as sendPacketCtx
+// returns, since WritePacket has serialized it onto the wire by then.
+var readRequestPool = sync.Pool{
+	New: func() interface{} { return new(pb.ReadRequest) },
+}
+
+// fetchRange issues exactly one pb.ReadRequest for [off, off+size) on
+// handle, bounded by the scheduler's in-flight window.
+func (fs *FS) fetchRange(ctx context.Context, handle uint64, off, size int64) ([]byte, fuse.Status) {
+	req := readRequestPool.Get().(*pb.ReadRequest)
+	h, o, s := handle, uint64(off), uint64(size)
+	req.Handle, req.Offset, req.Size = &h, &o, &s
+
+	resc, err := fs.sendPacketCtx(ctx, req)
+	readRequestPool.Put(req)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	select {
+	case resi := <-resc:
+		res, ok := resi.(*pb.ReadResponse)
+		if !ok {
+			vlogf("fs.Read = EIO due to wrong type")
+			return nil, fuse.EIO
+		}
+		return res.Data, fuse.OK
+	case <-ctx.Done():
+		return nil, fuse.EIO
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestSchedulerOptionsWithDefaults(t *testing.T) {
+	got := SchedulerOptions{}.withDefaults()
+	want := SchedulerOptions{
+		MaxInFlight:    DefaultMaxInFlight,
+		CoalesceWindow: DefaultCoalesceWindow,
+		ReadAhead:      0,
+	}
+	if got != want {
+		t.Fatalf("withDefaults() = %+v, want %+v", got, want)
+	}
+
+	got = SchedulerOptions{MaxInFlight: 8, CoalesceWindow: time.Second, ReadAhead: 4}.withDefaults()
+	want = SchedulerOptions{MaxInFlight: 8, CoalesceWindow: time.Second, ReadAhead: 4}
+	if got != want {
+		t.Fatalf("withDefaults() changed explicit values; got %+v, want %+v", got, want)
+	}
+
+	if got := (SchedulerOptions{ReadAhead: -1}).withDefaults(); got.ReadAhead != 0 {
+		t.Errorf("negative ReadAhead should clamp to 0, got %d", got.ReadAhead)
+	}
+}
+
+func TestBlockSliceWithinData(t *testing.T) {
+	data := make([]byte, 2*BlockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	lo := int64(100)
+
+	f := &blockFetch{off: lo + BlockSize}
+	res := blockSlice(f, lo, data, fuse.OK)
+	if !res.st.Ok() {
+		t.Fatalf("blockSlice status = %v, want OK", res.st)
+	}
+	want := data[BlockSize : 2*BlockSize]
+	if len(res.data) != len(want) || res.data[0] != want[0] {
+		t.Fatalf("blockSlice returned the wrong slice for a fetch in the middle of the batch")
+	}
+}
+
+func TestBlockSliceClampsShortRead(t *testing.T) {
+	// The upstream fetch returned less data than requested (EOF);
+	// a fetch whose block falls past what came back should get an
+	// empty, not out-of-range, slice.
+	data := make([]byte, BlockSize/2)
+	lo := int64(0)
+
+	f := &blockFetch{off: BlockSize}
+	res := blockSlice(f, lo, data, fuse.OK)
+	if !res.st.Ok() {
+		t.Fatalf("blockSlice status = %v, want OK", res.st)
+	}
+	if len(res.data) != 0 {
+		t.Errorf("expected an empty slice past EOF, got %d bytes", len(res.data))
+	}
+}
+
+func TestBlockSlicePropagatesError(t *testing.T) {
+	f := &blockFetch{off: 0}
+	res := blockSlice(f, 0, nil, fuse.EIO)
+	if res.st != fuse.EIO {
+		t.Errorf("blockSlice status = %v, want EIO", res.st)
+	}
+	if res.data != nil {
+		t.Errorf("blockSlice returned data alongside an error")
+	}
+}
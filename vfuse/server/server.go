@@ -4,10 +4,13 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dotcloud/docker/vfuse/pb"
@@ -41,6 +44,24 @@ func fuseError(err *pb.Error) fuse.Status {
 	if err.GetNotDir() {
 		return fuse.ENOTDIR
 	}
+	if err.GetAccessDenied() {
+		return fuse.EACCES
+	}
+	if err.GetExist() {
+		return fuse.EEXIST
+	}
+	if err.GetNotEmpty() {
+		return fuse.ENOTEMPTY
+	}
+	if err.GetNoSpace() {
+		return fuse.ENOSPC
+	}
+	if err.GetRange() {
+		return fuse.ERANGE
+	}
+	if err.GetNoData() {
+		return fuse.ENODATA
+	}
 	// TODO: more
 	return fuse.EIO
 }
@@ -51,11 +72,38 @@ func pbTime(t *time.Time) *pb.Time {
 	return &pb.Time{Sec: &sec, Nsec: &nsec}
 }
 
+// recv reads the single response off resc and asserts it to the
+// expected response type T, replacing the repeated
+// `res, ok := (<-resc).(*pb.FooResponse)` that used to appear at
+// most call sites with one generic helper (GetAttr and OpenDir still
+// assert on the received value directly). It doesn't change how
+// requests are framed or dispatched on the wire; a move to compact
+// opcode+header framing and an opcode-keyed dispatch table is tracked
+// as follow-up work against the vfuse package's Packet/Header types.
+func recv[T proto.Message](resc <-chan proto.Message) (T, bool) {
+	v, ok := (<-resc).(T)
+	return v, ok
+}
+
 // Server is the FUSE filesystem that relays all operations back to
 // the client.
 type Server struct {
 	*fuse.Server
 	Connector *nodefs.FileSystemConnector
+
+	fs     *FS
+	nodeFs *pathfs.PathNodeFs
+}
+
+// HasInvalidate reports whether the mounted kernel FUSE connection
+// supports unsolicited cache-invalidation notifications, mirroring
+// the conn.Protocol().HasInvalidate() check bazil.org/fuse's clockfs
+// example does before it relies on Notify{Entry,InodeData,Delete}.
+// The kernel gained inode invalidation in FUSE protocol 7.12 and
+// entry/delete notification in 7.18; below that, invalidation isn't
+// advertised and incoming InvalidateNotifications are ignored.
+func (s *Server) HasInvalidate() bool {
+	return s.Server.KernelSettings().Minor >= 18
 }
 
 // NewServer runs a relaying FUSE filesystem at mount.
@@ -64,24 +112,43 @@ type Server struct {
 // In practice (in Dockerd) this net.Conn will be hijacked
 // from an HTTP request when the client goes to attach
 // to a filesystem.
-func NewServer(mount string, clientConn func() net.Conn) (*Server, error) {
+//
+// cacheOpts controls the per-file block cache sitting in front of
+// Read, and schedOpts controls request pipelining (in-flight window,
+// fetch coalescing, read-ahead); the zero value of each selects sane
+// defaults.
+func NewServer(mount string, clientConn func() net.Conn, cacheOpts CacheOptions, schedOpts SchedulerOptions) (*Server, error) {
 	opts := &fuse.MountOptions{
 		Name: "vfuse_SOMECLIENT",
 	}
 	_ = opts
 
-	fs := newFS(clientConn)
+	fs := newFS(clientConn, cacheOpts, schedOpts)
 	nfs := pathfs.NewPathNodeFs(fs, nil)
+	fs.nodeFs = nfs
 
 	log.Printf("Mounting at %s", mount)
 	srv, fsConnector, err := nodefs.MountRoot(mount, nfs.Root(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("NewServer: %v", err)
 	}
-	return &Server{
+	s := &Server{
 		Server:    srv,
 		Connector: fsConnector,
-	}, nil
+		fs:        fs,
+		nodeFs:    nfs,
+	}
+	fs.invalidateSupported = s.HasInvalidate()
+	if !fs.invalidateSupported {
+		log.Printf("vfuse: kernel FUSE connection too old for cache invalidation notifications; ignoring any the client sends")
+	}
+	return s, nil
+}
+
+// CacheStats returns a snapshot of the block cache hit/miss/coalesce
+// counters for this server.
+func (s *Server) CacheStats() CacheStats {
+	return s.fs.cache.stats()
 }
 
 // FS is the implementation of the the pathfs.FileSystem interface.
@@ -94,16 +161,129 @@ type FS struct {
 	clientConn func() net.Conn // called once in initClient
 	vc         *vfuse.Client
 
-	mu     sync.Mutex // guards the following fields
-	nextid uint64
-	res    map[uint64]chan<- proto.Message
+	cache *blockCache   // block cache shared by every open file
+	batch *fetchBatcher // coalesces overlapping/adjacent block fetches
+	sem   chan struct{} // bounds in-flight requests to the client
+
+	readAhead int // blocks to prefetch once sequential access is detected
+
+	// nodeFs and invalidateSupported back the unsolicited
+	// InvalidateNotification path; both are set once, by NewServer,
+	// before fs is reachable from any FUSE op.
+	nodeFs              *pathfs.PathNodeFs
+	invalidateSupported bool
+
+	statfs statfsCache // short-TTL cache of the client's last StatFs answer
+
+	mu            sync.Mutex // guards the following fields
+	nextid        uint64
+	res           map[uint64]*waiter
+	cancelled     map[uint64]struct{}        // tombstones for ids whose ctx won the race with the response; see cancelRequestLocked
+	handlesByName map[string]map[uint64]bool // open handles, by the name they were opened with
+	nameByHandle  map[uint64]string          // reverse of handlesByName, for notifications keyed by handle
+}
+
+// statfsCache holds the most recent StatFs answer along with when it
+// was fetched, so repeated statfs(2) calls within statfsCacheTTL
+// don't each round-trip to the client.
+type statfsCache struct {
+	mu  sync.Mutex
+	at  time.Time
+	out fuse.StatfsOut
+}
+
+// waiter is what sendPacketCtx registers under a request ID: ch
+// receives the response, and done is closed exactly once, by whoever
+// removes the waiter from fs.res, so a ctx-cancellation watcher knows
+// not to act after the real response has already been delivered.
+type waiter struct {
+	ch   chan<- proto.Message
+	done chan struct{}
+}
+
+// waiterPool recycles *waiter structs across requests, the same way
+// readRequestPool (scheduler.go) recycles pb.ReadRequest: a waiter is
+// a small allocation on what's often the hottest path in the relay,
+// one per round trip to the client. It's returned to the pool once
+// forgetRequestLocked/cancelRequestLocked have taken it out of fs.res
+// and nobody holds a reference to it anymore.
+//
+// This doesn't go as far as a preallocated slab indexed by request ID
+// modulo the in-flight window: that would need a slot to be safely
+// reusable as soon as its semaphore token is released, but a
+// cancelled request frees its token before we know whether the
+// client will still send a late reply for that exact id (see
+// watchCancel/cancelRequestLocked) — reusing the slot for a new
+// request in that window would make the new request's id collide
+// with the old one's still-owed reply.
+var waiterPool = sync.Pool{
+	New: func() interface{} { return new(waiter) },
+}
+
+func newFS(clientConn func() net.Conn, cacheOpts CacheOptions, schedOpts SchedulerOptions) *FS {
+	schedOpts = schedOpts.withDefaults()
+	fs := &FS{
+		FileSystem:    pathfs.NewDefaultFileSystem(),
+		clientConn:    clientConn,
+		cache:         newBlockCache(cacheOpts),
+		sem:           make(chan struct{}, schedOpts.MaxInFlight),
+		readAhead:     schedOpts.ReadAhead,
+		nextid:        1, // ID 0 is reserved for unsolicited client notifications
+		res:           make(map[uint64]*waiter),
+		cancelled:     make(map[uint64]struct{}),
+		handlesByName: make(map[string]map[uint64]bool),
+		nameByHandle:  make(map[uint64]string),
+	}
+	fs.batch = newFetchBatcher(fs, schedOpts.CoalesceWindow)
+	return fs
 }
 
-func newFS(clientConn func() net.Conn) *FS {
-	return &FS{
-		FileSystem: pathfs.NewDefaultFileSystem(),
-		clientConn: clientConn,
-		res:        make(map[uint64]chan<- proto.Message),
+// addOpenHandleLocked records that handle was opened as name, so that
+// a later name-based invalidation (Chmod, Utimens, ...) can find and
+// evict its cached blocks. fs.mu must be held.
+func (fs *FS) addOpenHandleLocked(name string, handle uint64) {
+	set := fs.handlesByName[name]
+	if set == nil {
+		set = make(map[uint64]bool)
+		fs.handlesByName[name] = set
+	}
+	set[handle] = true
+	fs.nameByHandle[handle] = name
+}
+
+// forgetOpenHandle removes the (name, handle) association added by
+// addOpenHandleLocked, once the handle is closed.
+func (fs *FS) forgetOpenHandle(name string, handle uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	set := fs.handlesByName[name]
+	delete(set, handle)
+	if len(set) == 0 {
+		delete(fs.handlesByName, name)
+	}
+	delete(fs.nameByHandle, handle)
+}
+
+// nameForHandle returns the path handle was opened under, if it's
+// still open.
+func (fs *FS) nameForHandle(handle uint64) (string, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name, ok := fs.nameByHandle[handle]
+	return name, ok
+}
+
+// invalidateName evicts cached blocks for every handle currently open
+// under name, e.g. because Chmod or Utimens raced with a read.
+func (fs *FS) invalidateName(name string) {
+	fs.mu.Lock()
+	handles := make([]uint64, 0, len(fs.handlesByName[name]))
+	for h := range fs.handlesByName[name] {
+		handles = append(handles, h)
+	}
+	fs.mu.Unlock()
+	for _, h := range handles {
+		fs.cache.invalidateFile(h)
 	}
 }
 
@@ -115,28 +295,106 @@ func (fs *FS) initClient() {
 	go fs.readFromClient()
 }
 
-func (fs *FS) sendPacket(body proto.Message) (<-chan proto.Message, error) {
+// requestTimeout bounds how long a foreground FUSE op will wait on a
+// reply from the client. Without it, a slow or stuck client would
+// hang the calling kernel thread (and whatever userspace syscall is
+// blocked on it) forever: sendPacketCtx's cancellation plumbing only
+// helps a caller that actually has a ctx that can fire, and until now
+// nothing reaching sendPacket did.
+const requestTimeout = 30 * time.Second
+
+// sendPacket is sendPacketCtx with a context bounded by
+// requestTimeout, for the (common) callers that don't have a
+// cancellation source of their own. The returned cancel must be
+// called once the caller is done with resc, to release the timer
+// promptly instead of leaving it running until requestTimeout elapses.
+func (fs *FS) sendPacket(body proto.Message) (resc <-chan proto.Message, cancel context.CancelFunc, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	resc, err = fs.sendPacketCtx(ctx, body)
+	if err != nil {
+		cancel()
+		return nil, func() {}, err
+	}
+	return resc, cancel, nil
+}
+
+// sendPacketCtx writes body to the client as a new request and
+// returns a channel that will receive exactly one response. Sending
+// blocks until a slot is available in the connection's in-flight
+// window (see SchedulerOptions.MaxInFlight). If ctx is cancelled
+// before a response arrives, the pending waiter is dropped from
+// fs.res and its in-flight slot is released; the caller is expected
+// to also select on ctx.Done() rather than block forever on the
+// returned channel.
+func (fs *FS) sendPacketCtx(ctx context.Context, body proto.Message) (<-chan proto.Message, error) {
 	fs.clientOnce.Do(fs.initClient)
-	id, resc := fs.nextID()
+
+	select {
+	case fs.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	id, resc, done := fs.nextID()
 	if err := fs.vc.WritePacket(vfuse.Packet{
 		Header: vfuse.Header{
 			ID: id,
 		},
 		Body: body,
 	}); err != nil {
+		fs.mu.Lock()
+		fs.forgetRequestLocked(id)
+		fs.mu.Unlock()
+		<-fs.sem
 		return nil, err
 	}
+
+	if ctx.Done() != nil {
+		go fs.watchCancel(ctx, id, done)
+	}
 	return resc, nil
 }
 
-func (fs *FS) nextID() (uint64, <-chan proto.Message) {
+// watchCancel releases id's waiter and in-flight slot if ctx is
+// cancelled before the response arrives. If the response arrives
+// first, done is already closed and this returns without touching
+// fs.res again.
+//
+// Cancelling here doesn't stop the client from replying to id later;
+// it just means nobody's listening on resc anymore. cancelRequestLocked
+// leaves a tombstone behind so that readFromClient, when that late
+// response eventually shows up, can tell "nobody wanted this" apart
+// from "the client sent a response to a request we never made" and
+// drop it instead of aborting the connection.
+func (fs *FS) watchCancel(ctx context.Context, id uint64, done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	fs.mu.Lock()
+	w, ok := fs.res[id]
+	if ok {
+		fs.cancelRequestLocked(id)
+	}
+	fs.mu.Unlock()
+	if ok {
+		<-fs.sem
+		waiterPool.Put(w)
+	}
+}
+
+func (fs *FS) nextID() (uint64, <-chan proto.Message, chan struct{}) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	c := make(chan proto.Message, 1)
+	done := make(chan struct{})
 	id := fs.nextid
 	fs.nextid++
-	fs.res[id] = c
-	return id, c
+	w := waiterPool.Get().(*waiter)
+	w.ch, w.done = c, done
+	fs.res[id] = w
+	return id, c, done
 }
 
 func (fs *FS) readFromClient() {
@@ -146,39 +404,128 @@ func (fs *FS) readFromClient() {
 			log.Printf("fuse server: error reading client packet: %v", err)
 			return
 		}
+		if p.Header.ID == 0 {
+			// Unsolicited: the client is pushing a cache invalidation,
+			// not replying to a request of ours.
+			fs.handleInvalidate(p.Body)
+			continue
+		}
 		id := p.Header.ID
 		fs.mu.Lock()
-		resc, ok := fs.res[id]
+		w, ok := fs.res[id]
 		if ok {
 			fs.forgetRequestLocked(id)
+			fs.mu.Unlock()
+			w.ch <- p.Body
+			<-fs.sem
+			waiterPool.Put(w)
+			continue
+		}
+		_, tombstoned := fs.cancelled[id]
+		if tombstoned {
+			delete(fs.cancelled, id)
 		}
 		fs.mu.Unlock()
-		if !ok {
+		if !tombstoned {
 			log.Printf("fuse server: client sent bogus packet we didn't ask for; aborting")
 			return
 		}
-		resc <- p.Body
+		// watchCancel already gave up on id and released its
+		// in-flight slot; this is just the client's reply finally
+		// catching up. Nobody's listening, so drop it on the floor.
+	}
+}
+
+// handleInvalidate processes an unsolicited pb.InvalidateNotification
+// pushed by the client, dropping our own cached blocks and poking the
+// kernel (via PathNodeFs's Entry/File Notify) to drop its caches too,
+// so external changes to the underlying filesystem show up to
+// processes in the guest without polling.
+func (fs *FS) handleInvalidate(body proto.Message) {
+	n, ok := body.(*pb.InvalidateNotification)
+	if !ok {
+		vlogf("server: ignoring unsolicited packet of unexpected type %T", body)
+		return
+	}
+	if !fs.invalidateSupported {
+		vlogf("server: ignoring invalidate notification; kernel doesn't support it")
+		return
+	}
+	switch {
+	case n.GetDeleted():
+		// PathNodeFs has no delete-specific notification (true delete
+		// notification needs the removed child's own inode, which we
+		// don't have from a path alone); EntryNotify, the same call
+		// the Dir case below makes, is enough to make the kernel
+		// drop its dentry for the deleted name.
+		fs.invalidateName(joinPath(n.GetDir(), n.GetName()))
+		if st := fs.nodeFs.EntryNotify(n.GetDir(), n.GetName()); !st.Ok() {
+			vlogf("server: EntryNotify(%q, %q) = %v", n.GetDir(), n.GetName(), st)
+		}
+	case n.Handle != nil:
+		fs.cache.invalidateRange(n.GetHandle(), n.GetOffset(), n.GetLength())
+		if name, ok := fs.nameForHandle(n.GetHandle()); ok {
+			if st := fs.nodeFs.FileNotify(name, n.GetOffset(), n.GetLength()); !st.Ok() {
+				vlogf("server: FileNotify(%q) = %v", name, st)
+			}
+		}
+	case n.Dir != nil:
+		fs.invalidateName(joinPath(n.GetDir(), n.GetName()))
+		if st := fs.nodeFs.EntryNotify(n.GetDir(), n.GetName()); !st.Ok() {
+			vlogf("server: EntryNotify(%q, %q) = %v", n.GetDir(), n.GetName(), st)
+		}
+	default:
+		vlogf("server: empty invalidate notification")
 	}
 }
 
+// joinPath combines a directory and a child name the way pathfs names
+// entries: no leading slash, "" for the root.
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// forgetRequestLocked removes id's waiter from fs.res and wakes up
+// any goroutine (watchCancel) waiting to learn whether it lost the
+// race with the real response. fs.mu must be held.
 func (fs *FS) forgetRequestLocked(id uint64) {
+	w, ok := fs.res[id]
+	if !ok {
+		return
+	}
 	delete(fs.res, id)
+	close(w.done)
+}
+
+// cancelRequestLocked is forgetRequestLocked plus a tombstone: the
+// client may still send a reply for id after this returns (it has no
+// idea the caller stopped listening), and readFromClient needs to be
+// able to tell that late reply apart from a genuinely bogus packet.
+// fs.mu must be held.
+func (fs *FS) cancelRequestLocked(id uint64) {
+	fs.forgetRequestLocked(id)
+	fs.cancelled[id] = struct{}{}
 }
 
 func (fs *FS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
 	vlogf("fs.Chmod(%q)", name)
-	resc, err := fs.sendPacket(&pb.ChmodRequest{
+	resc, cancel, err := fs.sendPacket(&pb.ChmodRequest{
 		Name: &name,
 		Mode: &mode,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.ChmodResponse)
+	defer cancel()
+	res, ok := recv[*pb.ChmodResponse](resc)
 	if !ok {
 		vlogf("fs.Chmod(%q) = EIO because wrong type", name)
 		return fuse.EIO
 	}
+	fs.invalidateName(name)
 	return fuseError(res.Err)
 }
 
@@ -197,12 +544,13 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 		}, fuse.OK
 	}
 
-	resc, err := fs.sendPacket(&pb.AttrRequest{
+	resc, cancel, err := fs.sendPacket(&pb.AttrRequest{
 		Name: &name,
 	})
 	if err != nil {
 		return nil, fuse.EIO
 	}
+	defer cancel()
 	resi := <-resc
 	vlogf("fs.GetAttr(%q) read response %T, %v", name, resi, resi)
 	res, ok := resi.(*pb.AttrResponse)
@@ -231,30 +579,32 @@ func (fs *FS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Stat
 
 func (fs *FS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	vlogf("fs.Mkdir(%q, %o)", name, mode)
-	resc, err := fs.sendPacket(&pb.MkdirRequest{
+	resc, cancel, err := fs.sendPacket(&pb.MkdirRequest{
 		Name: &name,
 		Mode: &mode,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.MkdirResponse)
+	defer cancel()
+	res, ok := recv[*pb.MkdirResponse](resc)
 	if !ok {
 		vlogf("fs.Mkdir(%q) = EIO because wrong type", name)
 	}
 	return fuseError(res.Err)
 }
 
-func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+func (fs *FS) Open(name string, flags uint32, fctx *fuse.Context) (nodefs.File, fuse.Status) {
 	vlogf("fs.Open(%q, flags %d)", name, flags)
-	resc, err := fs.sendPacket(&pb.OpenRequest{
+	resc, cancel, err := fs.sendPacket(&pb.OpenRequest{
 		Name:  &name,
 		Flags: &flags,
 	})
 	if err != nil {
 		return nil, fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.OpenResponse)
+	defer cancel()
+	res, ok := recv[*pb.OpenResponse](resc)
 	if !ok {
 		return nil, fuse.EIO
 	}
@@ -269,21 +619,26 @@ func (fs *FS) Open(name string, flags uint32, context *fuse.Context) (nodefs.Fil
 		origName:  name,
 		origFlags: flags,
 	}
+	f.bgCtx, f.bgCancel = context.WithCancel(context.Background())
 	if f.handle == 0 {
 		return nil, fuse.EIO
 	}
+	fs.mu.Lock()
+	fs.addOpenHandleLocked(name, f.handle)
+	fs.mu.Unlock()
 	return f, fuse.OK
 }
 
 func (fs *FS) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	vlogf("fs.OpenDir(%q) ...", name)
-	resc, err := fs.sendPacket(&pb.ReaddirRequest{
+	resc, cancel, err := fs.sendPacket(&pb.ReaddirRequest{
 		Name: &name,
 	})
 	if err != nil {
 		vlogf("OpenDir error = %v", err)
 		return nil, fuse.EIO
 	}
+	defer cancel()
 	resi := <-resc
 	res, ok := resi.(*pb.ReaddirResponse)
 	if !ok {
@@ -303,13 +658,14 @@ func (fs *FS) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntr
 
 func (fs *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
 	vlogf("fs.Readlink(%q)", name)
-	resc, err := fs.sendPacket(&pb.ReadlinkRequest{
+	resc, cancel, err := fs.sendPacket(&pb.ReadlinkRequest{
 		Name: &name,
 	})
 	if err != nil {
 		return "", fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.ReadlinkResponse)
+	defer cancel()
+	res, ok := recv[*pb.ReadlinkResponse](resc)
 	if !ok {
 		vlogf("fs.Readlink(%q) = EIO because wrong type", name)
 		return "", fuse.EIO
@@ -322,14 +678,15 @@ func (fs *FS) Readlink(name string, context *fuse.Context) (string, fuse.Status)
 
 func (fs *FS) Rename(name string, target string, context *fuse.Context) fuse.Status {
 	vlogf("fs.Rename(%q, %q)", name, target)
-	resc, err := fs.sendPacket(&pb.RenameRequest{
+	resc, cancel, err := fs.sendPacket(&pb.RenameRequest{
 		Name:   &name,
 		Target: &target,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.RenameResponse)
+	defer cancel()
+	res, ok := recv[*pb.RenameResponse](resc)
 	if !ok {
 		vlogf("fs.Rename(%q, %q) = EIO", name, target)
 		return fuse.EIO
@@ -339,13 +696,14 @@ func (fs *FS) Rename(name string, target string, context *fuse.Context) fuse.Sta
 
 func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
 	vlogf("fs.Rmdir(%q)", name)
-	resc, err := fs.sendPacket(&pb.RmdirRequest{
+	resc, cancel, err := fs.sendPacket(&pb.RmdirRequest{
 		Name: &name,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.RmdirResponse)
+	defer cancel()
+	res, ok := recv[*pb.RmdirResponse](resc)
 	if !ok {
 		vlogf("fs.Rmdir(%q) = EIO because wrong type", name)
 	}
@@ -354,14 +712,15 @@ func (fs *FS) Rmdir(name string, context *fuse.Context) fuse.Status {
 
 func (fs *FS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
 	vlogf("fs.Symlink(%q, %q)", value, linkName)
-	resc, err := fs.sendPacket(&pb.SymlinkRequest{
+	resc, cancel, err := fs.sendPacket(&pb.SymlinkRequest{
 		Value: &value,
 		Name:  &linkName,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.SymlinkResponse)
+	defer cancel()
+	res, ok := recv[*pb.SymlinkResponse](resc)
 	if !ok {
 		vlogf("fs.Symlink(%q, %q) = EIO", value, linkName)
 		return fuse.EIO
@@ -371,7 +730,7 @@ func (fs *FS) Symlink(value string, linkName string, context *fuse.Context) fuse
 
 func (fs *FS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
 	vlogf("fs.Utimens(%q, atime: %v, mtime: %v)", name, atime, mtime)
-	resc, err := fs.sendPacket(&pb.UtimeRequest{
+	resc, cancel, err := fs.sendPacket(&pb.UtimeRequest{
 		Name:  &name,
 		Atime: pbTime(atime),
 		Mtime: pbTime(mtime),
@@ -379,17 +738,19 @@ func (fs *FS) Utimens(name string, atime *time.Time, mtime *time.Time, context *
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.UtimeResponse)
+	defer cancel()
+	res, ok := recv[*pb.UtimeResponse](resc)
 	if !ok {
 		vlogf("fs.Utimens(%q, %v, %v) = EIO because wrong type", name, atime, mtime)
 		return fuse.EIO
 	}
+	fs.invalidateName(name)
 	return fuseError(res.Err)
 }
 
 func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
 	vlogf("fs.Mknod(%q, mode: %d, dev: %d)", name, mode, dev)
-	resc, err := fs.sendPacket(&pb.MknodRequest{
+	resc, cancel, err := fs.sendPacket(&pb.MknodRequest{
 		Name: &name,
 		Mode: &mode,
 		Dev:  &dev,
@@ -397,7 +758,8 @@ func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context)
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.MknodResponse)
+	defer cancel()
+	res, ok := recv[*pb.MknodResponse](resc)
 	if !ok {
 		vlogf("fs.Mknod(%q, %d, %d) = EIO because wrong type", name, mode, dev)
 		return fuse.EIO
@@ -407,13 +769,14 @@ func (fs *FS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context)
 
 func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
 	vlogf("fs.Unlink(%q)", name)
-	resc, err := fs.sendPacket(&pb.UnlinkRequest{
+	resc, cancel, err := fs.sendPacket(&pb.UnlinkRequest{
 		Name: &name,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.UnlinkResponse)
+	defer cancel()
+	res, ok := recv[*pb.UnlinkResponse](resc)
 	if !ok {
 		vlogf("fs.Unlink(%q) = EIO because wrong type", name)
 		return fuse.EIO
@@ -424,34 +787,231 @@ func (fs *FS) Unlink(name string, context *fuse.Context) fuse.Status {
 
 func (fs *FS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
 	vlogf("fs.Truncate(%q, %d)", name, size)
-	resc, err := fs.sendPacket(&pb.TruncateRequest{
+	resc, cancel, err := fs.sendPacket(&pb.TruncateRequest{
 		Name: &name,
 		Size: &size,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.TruncateResponse)
+	defer cancel()
+	res, ok := recv[*pb.TruncateResponse](resc)
 	if !ok {
 		vlogf("fs.Truncate(%q, %d) = EIO because wrong type", name, size)
 		return fuse.EIO
 	}
-
+	fs.invalidateName(name)
 	return fuseError(res.Err)
 }
 
+// statfsCacheTTL bounds how often StatFs actually round-trips to the
+// client; callers that poll free space (apt, dd, docker build) tend
+// to call statfs(2) far more often than the answer actually changes.
+const statfsCacheTTL = 1 * time.Second
+
 func (fs *FS) StatFs(name string) *fuse.StatfsOut {
 	vlogf("fs.StatFs(%q)", name)
-	out := new(fuse.StatfsOut)
-	// TODO(bradfitz): make up some stuff for now. Do this properly later
-	// with a new packet type to the client.
-	out.Bsize = 1024
-	out.Blocks = 1e6
-	out.Bfree = out.Blocks / 2
-	out.Bavail = out.Blocks / 2
-	out.Files = 1e3
-	out.Ffree = 1e3 - 2
-	return out
+
+	fs.statfs.mu.Lock()
+	if fresh := time.Since(fs.statfs.at) < statfsCacheTTL; fresh {
+		out := fs.statfs.out
+		fs.statfs.mu.Unlock()
+		return &out
+	}
+	fs.statfs.mu.Unlock()
+
+	resc, cancel, err := fs.sendPacket(&pb.StatfsRequest{Name: &name})
+	if err != nil {
+		vlogf("fs.StatFs(%q) = EIO: %v", name, err)
+		return new(fuse.StatfsOut)
+	}
+	defer cancel()
+	res, ok := recv[*pb.StatfsResponse](resc)
+	if !ok {
+		vlogf("fs.StatFs(%q) = EIO because wrong type", name)
+		return new(fuse.StatfsOut)
+	}
+	if res.Err != nil {
+		vlogf("fs.StatFs(%q) failed: %v", name, fuseError(res.Err))
+		return new(fuse.StatfsOut)
+	}
+
+	out := fuse.StatfsOut{
+		Bsize:   res.GetBsize(),
+		Blocks:  res.GetBlocks(),
+		Bfree:   res.GetBfree(),
+		Bavail:  res.GetBavail(),
+		Files:   res.GetFiles(),
+		Ffree:   res.GetFfree(),
+		NameLen: res.GetNamelen(),
+	}
+
+	fs.statfs.mu.Lock()
+	fs.statfs.out = out
+	fs.statfs.at = time.Now()
+	fs.statfs.mu.Unlock()
+
+	return &out
+}
+
+func (fs *FS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	vlogf("fs.Access(%q, mode %o)", name, mode)
+	resc, cancel, err := fs.sendPacket(&pb.AccessRequest{
+		Name: &name,
+		Mask: &mode,
+	})
+	if err != nil {
+		return fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.AccessResponse](resc)
+	if !ok {
+		vlogf("fs.Access(%q) = EIO because wrong type", name)
+		return fuse.EIO
+	}
+	return fuseError(res.Err)
+}
+
+func (fs *FS) Create(name string, flags uint32, mode uint32, fctx *fuse.Context) (nodefs.File, fuse.Status) {
+	vlogf("fs.Create(%q, flags %d, mode %o)", name, flags, mode)
+	resc, cancel, err := fs.sendPacket(&pb.CreateRequest{
+		Name:  &name,
+		Flags: &flags,
+		Mode:  &mode,
+	})
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.CreateResponse](resc)
+	if !ok {
+		vlogf("fs.Create(%q) = EIO because wrong type", name)
+		return nil, fuse.EIO
+	}
+	if res.Err != nil {
+		return nil, fuseError(res.Err)
+	}
+	f := &file{
+		fs:        fs,
+		File:      nodefs.NewDefaultFile(),
+		handle:    res.GetHandle(),
+		origName:  name,
+		origFlags: flags,
+	}
+	f.bgCtx, f.bgCancel = context.WithCancel(context.Background())
+	if f.handle == 0 {
+		return nil, fuse.EIO
+	}
+	fs.mu.Lock()
+	fs.addOpenHandleLocked(name, f.handle)
+	fs.mu.Unlock()
+	return f, fuse.OK
+}
+
+func (fs *FS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	vlogf("fs.Link(%q, %q)", oldName, newName)
+	resc, cancel, err := fs.sendPacket(&pb.LinkRequest{
+		Target: &oldName,
+		Name:   &newName,
+	})
+	if err != nil {
+		return fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.LinkResponse](resc)
+	if !ok {
+		vlogf("fs.Link(%q, %q) = EIO because wrong type", oldName, newName)
+		return fuse.EIO
+	}
+	return fuseError(res.Err)
+}
+
+func (fs *FS) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	vlogf("fs.GetXAttr(%q, %q)", name, attribute)
+	resc, cancel, err := fs.sendPacket(&pb.XAttrGetRequest{
+		Name: &name,
+		Attr: &attribute,
+	})
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.XAttrGetResponse](resc)
+	if !ok {
+		vlogf("fs.GetXAttr(%q, %q) = EIO because wrong type", name, attribute)
+		return nil, fuse.EIO
+	}
+	if res.Err != nil {
+		return nil, fuseError(res.Err)
+	}
+	return res.Data, fuse.OK
+}
+
+func (fs *FS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	vlogf("fs.SetXAttr(%q, %q, %d bytes, flags %d)", name, attr, len(data), flags)
+	uflags := uint32(flags)
+	resc, cancel, err := fs.sendPacket(&pb.XAttrSetRequest{
+		Name:  &name,
+		Attr:  &attr,
+		Data:  data,
+		Flags: &uflags,
+	})
+	if err != nil {
+		return fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.XAttrSetResponse](resc)
+	if !ok {
+		vlogf("fs.SetXAttr(%q, %q) = EIO because wrong type", name, attr)
+		return fuse.EIO
+	}
+	fs.invalidateName(name)
+	return fuseError(res.Err)
+}
+
+func (fs *FS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	vlogf("fs.ListXAttr(%q)", name)
+	resc, cancel, err := fs.sendPacket(&pb.XAttrListRequest{
+		Name: &name,
+	})
+	if err != nil {
+		return nil, fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.XAttrListResponse](resc)
+	if !ok {
+		vlogf("fs.ListXAttr(%q) = EIO because wrong type", name)
+		return nil, fuse.EIO
+	}
+	if res.Err != nil {
+		return nil, fuseError(res.Err)
+	}
+	var names []string
+	for _, b := range bytes.Split(res.Names, []byte{0}) {
+		if len(b) > 0 {
+			names = append(names, string(b))
+		}
+	}
+	return names, fuse.OK
+}
+
+func (fs *FS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	vlogf("fs.RemoveXAttr(%q, %q)", name, attr)
+	resc, cancel, err := fs.sendPacket(&pb.XAttrRemoveRequest{
+		Name: &name,
+		Attr: &attr,
+	})
+	if err != nil {
+		return fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.XAttrRemoveResponse](resc)
+	if !ok {
+		vlogf("fs.RemoveXAttr(%q, %q) = EIO because wrong type", name, attr)
+		return fuse.EIO
+	}
+	fs.invalidateName(name)
+	return fuseError(res.Err)
 }
 
 // file implements http://godoc.org/github.com/hanwen/go-fuse/fuse/nodefs#File
@@ -466,54 +1026,192 @@ type file struct {
 	handle    uint64
 	origName  string // just for debugging
 	origFlags uint32 // just for debugging
+
+	// bgCtx is cancelled on Flush, so that read-ahead fetches
+	// started on this handle's behalf don't outlive it.
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+
+	seqMu      sync.Mutex // guards lastOff/lastSize, used to detect sequential access
+	lastOff    int64
+	lastSize   int64
+	haveLastOp bool
 }
 
 func (f *file) Flush() fuse.Status {
-	resc, err := f.fs.sendPacket(&pb.CloseRequest{
+	f.bgCancel()
+	resc, cancel, err := f.fs.sendPacket(&pb.CloseRequest{
 		Handle: &f.handle,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.CloseResponse)
+	defer cancel()
+	res, ok := recv[*pb.CloseResponse](resc)
 	if !ok {
 		vlogf("fs.Close = EIO due to wrong type")
 		return fuse.EIO
 	}
+	f.fs.cache.invalidateFile(f.handle)
+	f.fs.forgetOpenHandle(f.origName, f.handle)
 	return fuseError(res.Err)
 }
 
+// Read serves dest out of the block cache, fetching whole BlockSize
+// blocks from the client as needed. Fetches for blocks needed by this
+// call, and any read-ahead blocks triggered by it, are coalesced by
+// fs.batch into as few upstream ReadRequests as possible. Concurrent
+// reads that land on the same not-yet-fetched block additionally
+// coalesce onto a single fetch: the first caller to lock the block's
+// CacheBlock fills it in, everyone else blocks on that same lock and
+// then finds valid already true.
 func (f *file) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	vlogf("fs.Read(offset=%d, size=%d)", off, len(dest))
-	resc, err := f.fs.sendPacket(&pb.ReadRequest{
-		Handle: &f.handle,
-		Offset: proto.Uint64(uint64(off)),
-		Size:   proto.Uint64(uint64(len(dest))),
-	})
-	if err != nil {
-		return nil, fuse.EIO
+	f.maybeReadAhead(off, int64(len(dest)))
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	n, st := f.readCached(ctx, dest, off)
+	if !st.Ok() {
+		return nil, st
 	}
-	res, ok := (<-resc).(*pb.ReadResponse)
-	if !ok {
-		vlogf("fs.Read = EIO due to wrong type")
-		return nil, fuse.EIO
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+// maybeReadAhead records (off, size) as the file's last access and,
+// if it looks sequential (this read starts where the last one
+// ended), kicks off background fetches for the next few blocks so
+// they're already cached by the time the client asks for them.
+func (f *file) maybeReadAhead(off, size int64) {
+	f.seqMu.Lock()
+	sequential := f.haveLastOp && off == f.lastOff+f.lastSize
+	f.lastOff, f.lastSize, f.haveLastOp = off, size, true
+	f.seqMu.Unlock()
+
+	if !sequential || f.fs.readAhead == 0 {
+		return
+	}
+	start := blockStart(off+size-1) + BlockSize // first block past this read
+	for i := 0; i < f.fs.readAhead; i++ {
+		blockOff := start + int64(i)*BlockSize
+		go f.prefetchBlock(blockOff)
+	}
+}
+
+func (f *file) prefetchBlock(blockOff int64) {
+	block := f.fs.cache.getOrCreate(f.handle, blockOff)
+	if !block.mu.TryLock() {
+		return // already being fetched or already valid; nothing to do
+	}
+	defer block.mu.Unlock()
+	if block.valid {
+		return
+	}
+	data, st := f.fs.batch.fetch(f.bgCtx, f.handle, blockOff)
+	if !st.Ok() {
+		return
+	}
+	block.data = data
+	block.valid = true
+}
+
+func (f *file) readCached(ctx context.Context, dest []byte, off int64) (int, fuse.Status) {
+	start, end := off, off+int64(len(dest))
+	for start < end {
+		blockOff := blockStart(start)
+		block := f.fs.cache.getOrCreate(f.handle, blockOff)
+
+		locked := block.mu.TryLock()
+		if !locked {
+			atomic.AddInt64(&f.fs.cache.coalesced, 1)
+			block.mu.Lock()
+		}
+		if !block.valid {
+			data, st := f.fs.batch.fetch(ctx, f.handle, blockOff)
+			if !st.Ok() {
+				block.mu.Unlock()
+				return 0, st
+			}
+			block.data = data
+			block.valid = true
+			atomic.AddInt64(&f.fs.cache.misses, 1)
+		} else if locked {
+			atomic.AddInt64(&f.fs.cache.hits, 1)
+		}
+		data := block.data
+		block.mu.Unlock()
+
+		blockEnd := blockOff + int64(len(data))
+		lo, hi := start, end
+		if hi > blockEnd {
+			hi = blockEnd
+		}
+		if hi <= lo {
+			break // client returned a short (EOF) block
+		}
+		n := copy(dest[lo-off:hi-off], data[lo-blockOff:hi-blockOff])
+		start = lo + int64(n)
 	}
-	return fuse.ReadResultData(res.Data), fuse.OK
+	return int(start - off), fuse.OK
 }
 
 func (f *file) Truncate(size uint64) fuse.Status {
 	vlogf("fs.Truncate(size=%d)", size)
-	resc, err := f.fs.sendPacket(&pb.TruncateRequest{
+	resc, cancel, err := f.fs.sendPacket(&pb.TruncateRequest{
 		Handle: &f.handle,
 		Size:   &size,
 	})
 	if err != nil {
 		return fuse.EIO
 	}
-	res, ok := (<-resc).(*pb.TruncateResponse)
+	defer cancel()
+	res, ok := recv[*pb.TruncateResponse](resc)
 	if !ok {
 		vlogf("fs.Truncate(size=%d) = EIO due to wrong type", size)
 		return fuse.EIO
 	}
+	f.fs.cache.invalidateFile(f.handle)
+	return fuseError(res.Err)
+}
+
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	vlogf("fs.Write(offset=%d, size=%d)", off, len(data))
+	resc, cancel, err := f.fs.sendPacket(&pb.WriteRequest{
+		Handle: &f.handle,
+		Offset: proto.Uint64(uint64(off)),
+		Data:   data,
+	})
+	if err != nil {
+		return 0, fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.WriteResponse](resc)
+	if !ok {
+		vlogf("fs.Write = EIO due to wrong type")
+		return 0, fuse.EIO
+	}
+	if res.Err != nil {
+		return 0, fuseError(res.Err)
+	}
+	n := res.GetWritten()
+	f.fs.cache.invalidateRange(f.handle, off, int64(n))
+	return n, fuse.OK
+}
+
+func (f *file) Fsync(flags int) fuse.Status {
+	vlogf("fs.Fsync(handle=%d, flags=%d)", f.handle, flags)
+	dataOnly := flags != 0
+	resc, cancel, err := f.fs.sendPacket(&pb.FsyncRequest{
+		Handle:   &f.handle,
+		DataOnly: &dataOnly,
+	})
+	if err != nil {
+		return fuse.EIO
+	}
+	defer cancel()
+	res, ok := recv[*pb.FsyncResponse](resc)
+	if !ok {
+		vlogf("fs.Fsync = EIO due to wrong type")
+		return fuse.EIO
+	}
 	return fuseError(res.Err)
 }